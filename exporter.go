@@ -0,0 +1,614 @@
+// Copyright 2013 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Event is a single observation read off the statsd wire.
+type Event interface {
+	MetricName() string
+	Value() float64
+	Labels() map[string]string
+}
+
+// Events is a batch of Event, the unit the listeners hand to the Exporter.
+type Events []Event
+
+// CounterEvent is a statsd `c` sample.
+type CounterEvent struct {
+	metricName string
+	value      float64
+	labels     map[string]string
+}
+
+func (c *CounterEvent) MetricName() string        { return c.metricName }
+func (c *CounterEvent) Value() float64            { return c.value }
+func (c *CounterEvent) Labels() map[string]string { return c.labels }
+
+// GaugeEvent is a statsd `g` sample.
+type GaugeEvent struct {
+	metricName string
+	value      float64
+	relative   bool
+	labels     map[string]string
+}
+
+func (g *GaugeEvent) MetricName() string        { return g.metricName }
+func (g *GaugeEvent) Value() float64            { return g.value }
+func (g *GaugeEvent) Labels() map[string]string { return g.labels }
+
+// TimerEvent is a statsd `ms` sample, always in milliseconds.
+type TimerEvent struct {
+	metricName string
+	value      float64
+	labels     map[string]string
+}
+
+func (t *TimerEvent) MetricName() string        { return t.metricName }
+func (t *TimerEvent) Value() float64            { return t.value }
+func (t *TimerEvent) Labels() map[string]string { return t.labels }
+
+// HistogramEvent is a DogStatsD `h` sample. Unlike TimerEvent it is not
+// assumed to be in milliseconds, so its value is observed unscaled.
+type HistogramEvent struct {
+	metricName string
+	value      float64
+	labels     map[string]string
+}
+
+func (h *HistogramEvent) MetricName() string        { return h.metricName }
+func (h *HistogramEvent) Value() float64            { return h.value }
+func (h *HistogramEvent) Labels() map[string]string { return h.labels }
+
+// DistributionEvent is a DogStatsD `d` sample. It is unitless and its
+// value is observed unscaled.
+type DistributionEvent struct {
+	metricName string
+	value      float64
+	labels     map[string]string
+}
+
+func (d *DistributionEvent) MetricName() string        { return d.metricName }
+func (d *DistributionEvent) Value() float64            { return d.value }
+func (d *DistributionEvent) Labels() map[string]string { return d.labels }
+
+var (
+	metricsExpiredTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "statsd_exporter_metrics_expired_total",
+		Help: "The number of metrics removed from the registry after their TTL elapsed.",
+	}, []string{"type"})
+
+	eventsQueued = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "statsd_exporter_events_queued",
+		Help: "Number of events currently buffered on the ingestion channel, waiting for a worker.",
+	})
+
+	eventsDroppedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "statsd_exporter_events_dropped_total",
+		Help: "Total number of events dropped because the ingestion channel was full.",
+	})
+
+	eventProcessingDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "statsd_exporter_event_processing_duration_seconds",
+		Help: "Time a single worker spent applying one batch of events read off the ingestion channel.",
+	}, []string{"worker"})
+)
+
+func init() {
+	prometheus.MustRegister(metricsExpiredTotal, eventsQueued, eventsDroppedTotal, eventProcessingDuration)
+}
+
+// defaultWorkerPoolSize is how many goroutines concurrently drain the
+// events channel when an Exporter doesn't override it via Workers.
+const defaultWorkerPoolSize = 4
+
+// containerLock guards a metric container's Elements map with a single
+// mutex shared by every series in the container. An earlier revision
+// sharded this lock across several mutexes keyed by hashing the series
+// name, but every shard still guarded the same Elements map, so two
+// workers hashing to different shards could race on a concurrent map
+// read/write. A single mutex per container closes that hole; contention
+// is still spread across containers (counters, gauges, summaries and
+// histograms each lock independently) and across the worker pool's
+// per-batch work.
+type containerLock struct {
+	mu sync.Mutex
+}
+
+func (c *containerLock) lock(key string) *sync.Mutex {
+	return &c.mu
+}
+
+func (c *containerLock) lockAll() {
+	c.mu.Lock()
+}
+
+func (c *containerLock) unlockAll() {
+	c.mu.Unlock()
+}
+
+// metricExpiry tracks the idle clock for a single registered series,
+// independent of the series' own value.
+type metricExpiry struct {
+	lastSeen time.Time
+	ttl      time.Duration
+	expireOn expirationMode
+}
+
+func (e *metricExpiry) expired(now time.Time) bool {
+	return e.ttl > 0 && now.Sub(e.lastSeen) > e.ttl
+}
+
+// CounterContainer holds every counter the Exporter has registered, keyed
+// by hashNameAndLabels(name, labels). Access to Elements should go through
+// the embedded containerLock so concurrent workers never read/write the
+// map unsynchronized.
+type CounterContainer struct {
+	Elements map[string]prometheus.Counter
+	containerLock
+}
+
+func NewCounterContainer() *CounterContainer {
+	return &CounterContainer{Elements: make(map[string]prometheus.Counter)}
+}
+
+// GaugeContainer holds every gauge the Exporter has registered.
+type GaugeContainer struct {
+	Elements map[string]prometheus.Gauge
+	containerLock
+}
+
+func NewGaugeContainer() *GaugeContainer {
+	return &GaugeContainer{Elements: make(map[string]prometheus.Gauge)}
+}
+
+// SummaryContainer holds every summary the Exporter has registered.
+type SummaryContainer struct {
+	Elements map[string]prometheus.Summary
+	containerLock
+}
+
+func NewSummaryContainer() *SummaryContainer {
+	return &SummaryContainer{Elements: make(map[string]prometheus.Summary)}
+}
+
+// HistogramContainer holds every histogram the Exporter has registered.
+type HistogramContainer struct {
+	Elements map[string]prometheus.Histogram
+	containerLock
+}
+
+func NewHistogramContainer() *HistogramContainer {
+	return &HistogramContainer{Elements: make(map[string]prometheus.Histogram)}
+}
+
+// Exporter accumulates statsd Events into Prometheus metrics and serves
+// them for scraping.
+type Exporter struct {
+	mapper *metricMapper
+
+	Counters   *CounterContainer
+	Gauges     *GaugeContainer
+	Summaries  *SummaryContainer
+	Histograms *HistogramContainer
+
+	mu     sync.Mutex
+	expiry map[string]*metricExpiry
+
+	cleanupEnabled  bool
+	cleanupInterval time.Duration
+	defaultTTL      time.Duration
+
+	// Workers is how many goroutines concurrently drain the events channel
+	// passed to Listen. Defaults to defaultWorkerPoolSize; callers may
+	// change it before calling Listen to size the pool for their load.
+	Workers int
+}
+
+// NewExporter creates an Exporter that maps incoming Events through mapper.
+// cleanupEnabled, cleanupInterval and defaultTTL govern MetricsCleanup: when
+// disabled, idle series are kept forever; otherwise a series idle for more
+// than its effective TTL (mapping override, else defaultTTL) is removed at
+// most once per cleanupInterval, evaluated on a wall-clock ticker rather
+// than piggybacking on the next event.
+func NewExporter(mapper *metricMapper, cleanupEnabled bool, cleanupInterval, defaultTTL time.Duration) *Exporter {
+	return &Exporter{
+		mapper:          mapper,
+		Counters:        NewCounterContainer(),
+		Gauges:          NewGaugeContainer(),
+		Summaries:       NewSummaryContainer(),
+		Histograms:      NewHistogramContainer(),
+		expiry:          make(map[string]*metricExpiry),
+		cleanupEnabled:  cleanupEnabled,
+		cleanupInterval: cleanupInterval,
+		defaultTTL:      defaultTTL,
+		Workers:         defaultWorkerPoolSize,
+	}
+}
+
+// hashNameAndLabels builds the key used across every metric container, so
+// that a series is looked up the same way regardless of label order.
+func hashNameAndLabels(name string, labels map[string]string) string {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		h.Write([]byte{0})
+		h.Write([]byte(k))
+		h.Write([]byte{0})
+		h.Write([]byte(labels[k]))
+	}
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+// escapeMetricName replaces every rune that is not valid in a Prometheus
+// metric name with `_`, and prefixes a leading digit with `_` as well.
+func escapeMetricName(metricName string) string {
+	if len(metricName) == 0 {
+		return metricName
+	}
+
+	var out strings.Builder
+	if unicode.IsDigit(rune(metricName[0])) {
+		out.WriteByte('_')
+	}
+	for _, r := range metricName {
+		if unicode.IsDigit(r) || unicode.IsLetter(r) || r == '_' {
+			out.WriteRune(r)
+		} else {
+			out.WriteByte('_')
+		}
+	}
+	return out.String()
+}
+
+func (e *Exporter) ttlAndExpireOn(mapping *metricMapping) (time.Duration, expirationMode) {
+	ttl := e.mapper.ttlFor(mapping)
+	if ttl == 0 {
+		ttl = e.defaultTTL
+	}
+	return ttl, e.mapper.expireOnFor(mapping)
+}
+
+// touch records that key was just observed (or scraped), for the purposes
+// of MetricsCleanup.
+func (e *Exporter) touch(metricType, key string, mapping *metricMapping, viaScrape bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	expiry, ok := e.expiry[metricType+":"+key]
+	if !ok {
+		ttl, expireOn := e.ttlAndExpireOn(mapping)
+		expiry = &metricExpiry{ttl: ttl, expireOn: expireOn, lastSeen: time.Now()}
+		e.expiry[metricType+":"+key] = expiry
+	}
+
+	if viaScrape && expiry.expireOn != expireOnLastScrape {
+		return
+	}
+	if !viaScrape && expiry.expireOn != expireOnLastObservation {
+		return
+	}
+	expiry.lastSeen = time.Now()
+}
+
+func (e *Exporter) handleEvent(event Event) {
+	mapping, mappedName, mappedLabels := e.mapper.getMapping(event.MetricName())
+	name := mappedName
+	if name == "" {
+		name = event.MetricName()
+	}
+	name = escapeMetricName(name)
+	labels := mappedLabels
+	if labels == nil {
+		labels = event.Labels()
+	}
+
+	switch ev := event.(type) {
+	case *CounterEvent:
+		if ev.Value() < 0 {
+			log.Errorf("Counter %q cannot decrease in value, discarding event with value %f", name, ev.Value())
+			return
+		}
+		key := hashNameAndLabels(name, labels)
+		lock := e.Counters.lock(key)
+		lock.Lock()
+		counter, ok := e.Counters.Elements[key]
+		if !ok {
+			counter = prometheus.NewCounter(prometheus.CounterOpts{
+				Name:        name,
+				Help:        "Metric autogenerated by statsd_exporter.",
+				ConstLabels: prometheus.Labels(labels),
+			})
+			e.Counters.Elements[key] = counter
+		}
+		counter.Add(ev.Value())
+		lock.Unlock()
+		e.touch("counter", key, mapping, false)
+
+	case *GaugeEvent:
+		key := hashNameAndLabels(name, labels)
+		lock := e.Gauges.lock(key)
+		lock.Lock()
+		gauge, ok := e.Gauges.Elements[key]
+		if !ok {
+			gauge = prometheus.NewGauge(prometheus.GaugeOpts{
+				Name:        name,
+				Help:        "Metric autogenerated by statsd_exporter.",
+				ConstLabels: prometheus.Labels(labels),
+			})
+			e.Gauges.Elements[key] = gauge
+		}
+		if ev.relative {
+			gauge.Add(ev.Value())
+		} else {
+			gauge.Set(ev.Value())
+		}
+		lock.Unlock()
+		e.touch("gauge", key, mapping, false)
+
+	case *TimerEvent:
+		key := hashNameAndLabels(name, labels)
+		e.observeTiming(name, labels, mapping, ev.Value()/1000)
+		e.touch("timer", key, mapping, false)
+
+	case *HistogramEvent:
+		key := hashNameAndLabels(name, labels)
+		e.observeTiming(name, labels, mapping, ev.Value())
+		e.touch("timer", key, mapping, false)
+
+	case *DistributionEvent:
+		key := hashNameAndLabels(name, labels)
+		e.observeTiming(name, labels, mapping, ev.Value())
+		e.touch("timer", key, mapping, false)
+
+	default:
+		log.Errorf("Unsupported event type %T", event)
+	}
+}
+
+// observeTiming records value, unscaled, into the histogram or summary for
+// name/labels, creating it on first use per the mapping's timer_type.
+// Shared by TimerEvent (which pre-scales ms to seconds before calling this),
+// HistogramEvent and DistributionEvent (both unitless).
+func (e *Exporter) observeTiming(name string, labels map[string]string, mapping *metricMapping, value float64) {
+	key := hashNameAndLabels(name, labels)
+	switch e.mapper.timerTypeFor(mapping) {
+	case timerTypeHistogram:
+		lock := e.Histograms.lock(key)
+		lock.Lock()
+		defer lock.Unlock()
+		histogram, ok := e.Histograms.Elements[key]
+		if !ok {
+			opts := prometheus.HistogramOpts{
+				Name:        name,
+				Help:        "Metric autogenerated by statsd_exporter.",
+				ConstLabels: prometheus.Labels(labels),
+			}
+			if buckets := bucketsFor(mapping, e.mapper); buckets != nil {
+				opts.Buckets = buckets
+			}
+			histogram = prometheus.NewHistogram(opts)
+			e.Histograms.Elements[key] = histogram
+		}
+		histogram.Observe(value)
+	default:
+		lock := e.Summaries.lock(key)
+		lock.Lock()
+		defer lock.Unlock()
+		summary, ok := e.Summaries.Elements[key]
+		if !ok {
+			opts := prometheus.SummaryOpts{
+				Name:        name,
+				Help:        "Metric autogenerated by statsd_exporter.",
+				ConstLabels: prometheus.Labels(labels),
+			}
+			if objectives := quantilesFor(mapping, e.mapper); objectives != nil {
+				opts.Objectives = objectives
+			}
+			summary = prometheus.NewSummary(opts)
+			e.Summaries.Elements[key] = summary
+		}
+		summary.Observe(value)
+	}
+}
+
+// bucketsFor resolves the effective histogram buckets for a (possibly nil)
+// matched mapping, falling back to the mapper-wide default.
+func bucketsFor(mapping *metricMapping, mapper *metricMapper) []float64 {
+	if mapping != nil && len(mapping.Buckets) > 0 {
+		return mapping.Buckets
+	}
+	return mapper.Defaults.Buckets
+}
+
+// quantilesFor resolves the effective summary quantiles for a (possibly
+// nil) matched mapping, falling back to the mapper-wide default.
+func quantilesFor(mapping *metricMapping, mapper *metricMapper) map[float64]float64 {
+	var objectives []metricObjective
+	if mapping != nil {
+		objectives = mapping.Quantiles
+	}
+	if len(objectives) == 0 {
+		objectives = mapper.Defaults.Quantiles
+	}
+	if len(objectives) == 0 {
+		return nil
+	}
+	out := make(map[float64]float64, len(objectives))
+	for _, o := range objectives {
+		out[o.Quantile] = o.Error
+	}
+	return out
+}
+
+// MetricsCleanup drops every registered series whose idle clock has
+// exceeded its TTL, incrementing statsd_exporter_metrics_expired_total for
+// each one removed. It takes every container's lock for the duration of
+// the scan, so it runs against a consistent snapshot even
+// while the worker pool is concurrently applying new events.
+func (e *Exporter) MetricsCleanup() {
+	e.Counters.lockAll()
+	defer e.Counters.unlockAll()
+	e.Gauges.lockAll()
+	defer e.Gauges.unlockAll()
+	e.Summaries.lockAll()
+	defer e.Summaries.unlockAll()
+	e.Histograms.lockAll()
+	defer e.Histograms.unlockAll()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := time.Now()
+	for compositeKey, expiry := range e.expiry {
+		if !expiry.expired(now) {
+			continue
+		}
+
+		parts := strings.SplitN(compositeKey, ":", 2)
+		metricType, key := parts[0], parts[1]
+		switch metricType {
+		case "counter":
+			delete(e.Counters.Elements, key)
+		case "gauge":
+			delete(e.Gauges.Elements, key)
+		case "timer":
+			delete(e.Summaries.Elements, key)
+			delete(e.Histograms.Elements, key)
+		}
+		delete(e.expiry, compositeKey)
+		metricsExpiredTotal.WithLabelValues(metricType).Inc()
+	}
+}
+
+// Listen drains events until the channel is closed, fanning batches out to
+// a pool of e.Workers goroutines so one slow batch can't block the rest,
+// and (if cleanup is enabled) runs MetricsCleanup on an independent
+// wall-clock ticker rather than waiting for the next batch to arrive.
+// Workers still serialize on each metric container's single containerLock,
+// so the pool parallelizes event decoding and the per-event work done
+// before a counter/gauge/summary/histogram is touched, not the map access
+// itself; it does not eliminate lock contention across the pool.
+func (e *Exporter) Listen(events <-chan Events) {
+	workers := e.Workers
+	if workers < 1 {
+		workers = defaultWorkerPoolSize
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(workerID string) {
+			defer wg.Done()
+			for eventsBatch := range events {
+				eventsQueued.Sub(float64(len(eventsBatch)))
+				start := time.Now()
+				for _, event := range eventsBatch {
+					e.handleEvent(event)
+				}
+				eventProcessingDuration.WithLabelValues(workerID).Observe(time.Since(start).Seconds())
+			}
+		}(strconv.Itoa(i))
+	}
+
+	stopCleanup := make(chan struct{})
+	cleanupDone := make(chan struct{})
+	if e.cleanupEnabled {
+		go func() {
+			defer close(cleanupDone)
+			ticker := time.NewTicker(e.cleanupInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					e.MetricsCleanup()
+				case <-stopCleanup:
+					return
+				}
+			}
+		}()
+	} else {
+		close(cleanupDone)
+	}
+
+	wg.Wait()
+	close(stopCleanup)
+	<-cleanupDone
+}
+
+// Describe implements prometheus.Collector.
+func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
+	metricsExpiredTotal.Describe(ch)
+	eventsQueued.Describe(ch)
+	eventsDroppedTotal.Describe(ch)
+	eventProcessingDuration.Describe(ch)
+}
+
+// Collect implements prometheus.Collector. Series mapped with
+// expire_on: last_scrape have their idle clock reset here.
+func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
+	e.mu.Lock()
+	for _, expiry := range e.expiry {
+		if expiry.expireOn != expireOnLastScrape {
+			continue
+		}
+		expiry.lastSeen = time.Now()
+	}
+	e.mu.Unlock()
+
+	e.Counters.lockAll()
+	for _, c := range e.Counters.Elements {
+		ch <- c
+	}
+	e.Counters.unlockAll()
+
+	e.Gauges.lockAll()
+	for _, g := range e.Gauges.Elements {
+		ch <- g
+	}
+	e.Gauges.unlockAll()
+
+	e.Summaries.lockAll()
+	for _, s := range e.Summaries.Elements {
+		ch <- s
+	}
+	e.Summaries.unlockAll()
+
+	e.Histograms.lockAll()
+	for _, h := range e.Histograms.Elements {
+		ch <- h
+	}
+	e.Histograms.unlockAll()
+
+	metricsExpiredTotal.Collect(ch)
+	eventsQueued.Collect(ch)
+	eventsDroppedTotal.Collect(ch)
+	eventProcessingDuration.Collect(ch)
+}
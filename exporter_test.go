@@ -16,10 +16,13 @@ package main
 import (
 	"fmt"
 	"net"
+	"regexp"
 	"testing"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 )
 
 // TestNegativeCounter validates when we send a negative
@@ -44,7 +47,7 @@ func TestNegativeCounter(t *testing.T) {
 		},
 	}
 	events <- c
-	ex := NewExporter(&metricMapper{},false,0,0)
+	ex := NewExporter(&metricMapper{}, false, 0, 0)
 
 	// Close channel to signify we are done with the listener after a short period.
 	go func() {
@@ -60,7 +63,7 @@ func TestNegativeCounter(t *testing.T) {
 // It sends the same tags first with a valid value, then with an invalid one.
 // The exporter should not panic, but drop the invalid event
 func TestInvalidUtf8InDatadogTagValue(t *testing.T) {
-	ex := NewExporter(&metricMapper{},false,0,0)
+	ex := NewExporter(&metricMapper{}, false, 0, 0)
 	for _, l := range []statsDPacketHandler{&StatsDUDPListener{}, &mockStatsDTCPListener{}} {
 		events := make(chan Events, 2)
 
@@ -96,7 +99,7 @@ func TestHistogramUnits(t *testing.T) {
 		},
 	}
 	events <- c
-	ex := NewExporter(&metricMapper{},false,0,0)
+	ex := NewExporter(&metricMapper{}, false, 0, 0)
 	ex.mapper.Defaults.TimerType = timerTypeHistogram
 
 	// Close channel to signify we are done with the listener after a short period.
@@ -115,6 +118,63 @@ func TestHistogramUnits(t *testing.T) {
 	}
 }
 
+// TestDistributionUnits validates that, unlike timers, DogStatsD
+// distribution samples are observed unscaled: a `foo:300|d` sample must be
+// observed as 300, not 0.3.
+func TestDistributionUnits(t *testing.T) {
+	events := make(chan Events, 1)
+	name := "foo"
+	c := Events{
+		&DistributionEvent{
+			metricName: name,
+			value:      300,
+		},
+	}
+	events <- c
+	ex := NewExporter(&metricMapper{}, false, 0, 0)
+	ex.mapper.Defaults.TimerType = timerTypeHistogram
+
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		close(events)
+	}()
+	mock := &MockHistogram{}
+	key := hashNameAndLabels(name, nil)
+	ex.Histograms.Elements[key] = mock
+	ex.Listen(events)
+	if mock.value != 300 {
+		t.Fatalf("Expected distribution observation to be unscaled at 300, got %f", mock.value)
+	}
+}
+
+// TestHistogramEventUnits validates that a DogStatsD `h` sample is also
+// observed unscaled, the same as a distribution.
+func TestHistogramEventUnits(t *testing.T) {
+	events := make(chan Events, 1)
+	name := "foo"
+	c := Events{
+		&HistogramEvent{
+			metricName: name,
+			value:      300,
+		},
+	}
+	events <- c
+	ex := NewExporter(&metricMapper{}, false, 0, 0)
+	ex.mapper.Defaults.TimerType = timerTypeHistogram
+
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		close(events)
+	}()
+	mock := &MockHistogram{}
+	key := hashNameAndLabels(name, nil)
+	ex.Histograms.Elements[key] = mock
+	ex.Listen(events)
+	if mock.value != 300 {
+		t.Fatalf("Expected histogram-event observation to be unscaled at 300, got %f", mock.value)
+	}
+}
+
 type statsDPacketHandler interface {
 	handlePacket(packet []byte, e chan<- Events)
 }
@@ -172,35 +232,73 @@ func TestEscapeMetricName(t *testing.T) {
 	}
 }
 
+// TestDogStatsDDistributionAndHistogramParsing validates that `|d` and `|h`
+// suffixes are recognized by the packet handlers and produce the
+// corresponding DistributionEvent/HistogramEvent, not a TimerEvent.
+func TestDogStatsDDistributionAndHistogramParsing(t *testing.T) {
+	for _, l := range []statsDPacketHandler{&StatsDUDPListener{}, &mockStatsDTCPListener{}} {
+		events := make(chan Events, 2)
+		l.handlePacket([]byte("foo:300|d\nbar:300|h"), events)
+		close(events)
+
+		var sawDistribution, sawHistogram bool
+		for batch := range events {
+			for _, event := range batch {
+				switch event.(type) {
+				case *DistributionEvent:
+					sawDistribution = true
+				case *HistogramEvent:
+					sawHistogram = true
+				case *TimerEvent:
+					t.Fatalf("`|d` and `|h` samples must not be parsed as TimerEvent")
+				}
+			}
+		}
+		if !sawDistribution {
+			t.Fatalf("Expected a DistributionEvent for the `|d` sample")
+		}
+		if !sawHistogram {
+			t.Fatalf("Expected a HistogramEvent for the `|h` sample")
+		}
+	}
+}
 
-func TestMetricsCleanup(t *testing.T){
-	ex := NewExporter(&metricMapper{},true,time.Duration(50 * time.Millisecond),time.Duration(50 * time.Millisecond))
+func TestMetricsCleanup(t *testing.T) {
+	ex := NewExporter(&metricMapper{}, true, time.Duration(50*time.Millisecond), time.Duration(50*time.Millisecond))
 	for _, l := range []statsDPacketHandler{&StatsDUDPListener{}, &mockStatsDTCPListener{}} {
 		events := make(chan Events, 2)
 
 		l.handlePacket([]byte("foo:200|c|#tag:value\nbar:200|c|#tag:value"), events)
 
-		// Close the channel after 250ms, so the ex.Listen() call returns for the validation of the test.
+		// Keep 'foo' alive with ongoing traffic while 'bar' is left idle, so
+		// MetricsCleanup's own wall-clock ticker - not a trailing packet -
+		// is what drives the eviction of 'bar'.
 		go func() {
-			time.Sleep(time.Millisecond * 250)
-			// we pump another metric through, in order to force the evaluation of metrics cleanup
-			// this is due to the blocking read of the exporter from the event channel.
-			l.handlePacket([]byte("foo:200|c|#tag:value\n"), events)
-			close(events)
+			ticker := time.NewTicker(time.Millisecond * 20)
+			defer ticker.Stop()
+			deadline := time.After(time.Millisecond * 250)
+			for {
+				select {
+				case <-ticker.C:
+					l.handlePacket([]byte("foo:200|c|#tag:value\n"), events)
+				case <-deadline:
+					close(events)
+					return
+				}
+			}
 		}()
 
 		ex.Listen(events)
 
-
 		// verify that the 'bar' metric is no longer in the collection and that only 'foo' remains
-		if !(len(ex.Counters.Elements)==1) {
-			t.Fatalf("The count of counters in the collection does not match expectations (of 1): %d",len(ex.Counters.Elements) )
-		}else{
+		if !(len(ex.Counters.Elements) == 1) {
+			t.Fatalf("The count of counters in the collection does not match expectations (of 1): %d", len(ex.Counters.Elements))
+		} else {
 			// check that it is only the foo counter in the collection and not bar
-			for k,_ := range ex.Counters.Elements {
+			for k, _ := range ex.Counters.Elements {
 				actualCounterDesc := ex.Counters.Elements[k].Desc().String()
-				if actualCounterDesc!= "Desc{fqName: \"foo\", help: \"Metric autogenerated by statsd_exporter.\", constLabels: {tag=\"value\"}, variableLabels: []}"{
-					t.Fatalf("Did not find the expected remaining counter 'foo' in the counter collection. Actual: %s",actualCounterDesc)
+				if actualCounterDesc != "Desc{fqName: \"foo\", help: \"Metric autogenerated by statsd_exporter.\", constLabels: {tag=\"value\"}, variableLabels: []}" {
+					t.Fatalf("Did not find the expected remaining counter 'foo' in the counter collection. Actual: %s", actualCounterDesc)
 				}
 
 			}
@@ -208,4 +306,134 @@ func TestMetricsCleanup(t *testing.T){
 		}
 	}
 
-}
\ No newline at end of file
+}
+
+// TestMetricsCleanupExpireOnLastScrape validates that a mapping with
+// expire_on: last_scrape keeps a series alive across Collect() calls even
+// when no new events arrive, but still expires it once scraping stops.
+func TestMetricsCleanupExpireOnLastScrape(t *testing.T) {
+	mapper := &metricMapper{}
+	mapper.Defaults.Ttl = 100 * time.Millisecond
+	mapper.Defaults.ExpireOn = expireOnLastScrape
+
+	ex := NewExporter(mapper, true, 30*time.Millisecond, 100*time.Millisecond)
+	events := make(chan Events, 1)
+	events <- Events{&CounterEvent{metricName: "kept_alive", value: 1}}
+
+	go func() {
+		time.Sleep(time.Millisecond * 250)
+		close(events)
+	}()
+
+	// Simulate scrapes happening faster than the TTL, which should keep
+	// resetting the idle clock for as long as the Listen loop runs.
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		discard := make(chan prometheus.Metric, 16)
+		for {
+			select {
+			case <-ticker.C:
+				ex.Collect(discard)
+				for len(discard) > 0 {
+					<-discard
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	ex.Listen(events)
+	close(stop)
+
+	if len(ex.Counters.Elements) != 1 {
+		t.Fatalf("Expected the last_scrape-mapped counter to survive while being scraped, got %d counters", len(ex.Counters.Elements))
+	}
+}
+
+// TestMetricsCleanupPerMappingTTLOverride validates that a mapping-level
+// ttl overrides the mapper-wide default.
+func TestMetricsCleanupPerMappingTTLOverride(t *testing.T) {
+	mapper := &metricMapper{}
+	mapper.Defaults.Ttl = time.Hour
+	mapper.Mappings = []metricMapping{
+		{Match: "^short\\..*$", Name: "short", Ttl: 30 * time.Millisecond, regex: regexp.MustCompile("^short\\..*$")},
+	}
+
+	ex := NewExporter(mapper, true, 20*time.Millisecond, 0)
+	events := make(chan Events, 2)
+	events <- Events{&CounterEvent{metricName: "short.lived", value: 1}}
+	events <- Events{&CounterEvent{metricName: "long.lived", value: 1}}
+
+	go func() {
+		time.Sleep(time.Millisecond * 150)
+		close(events)
+	}()
+
+	ex.Listen(events)
+
+	if len(ex.Counters.Elements) != 1 {
+		t.Fatalf("Expected only the long-lived, default-TTL counter to remain, got %d counters", len(ex.Counters.Elements))
+	}
+}
+
+// TestWorkerPoolDrainsAllEvents validates that Listen's worker pool still
+// applies every batch handed to it, regardless of how many workers are
+// draining the channel concurrently. It uses many distinct metric names so
+// that, with ex.Workers > 1, different counters are very likely to be
+// handled by different goroutines at the same time - the scenario that
+// exercises concurrent access to the shared Counters container.
+func TestWorkerPoolDrainsAllEvents(t *testing.T) {
+	ex := NewExporter(&metricMapper{}, false, 0, 0)
+	ex.Workers = 8
+
+	const metricCount = 20
+	const incrementsPerMetric = 50
+
+	events := make(chan Events, metricCount*incrementsPerMetric)
+	for i := 0; i < metricCount; i++ {
+		name := fmt.Sprintf("hits_%d", i)
+		for j := 0; j < incrementsPerMetric; j++ {
+			events <- Events{&CounterEvent{metricName: name, value: 1}}
+		}
+	}
+	close(events)
+
+	ex.Listen(events)
+
+	for i := 0; i < metricCount; i++ {
+		name := fmt.Sprintf("hits_%d", i)
+		key := hashNameAndLabels(name, nil)
+		counter, ok := ex.Counters.Elements[key]
+		if !ok {
+			t.Fatalf("Expected a %q counter to have been registered", name)
+		}
+		metric := &dto.Metric{}
+		if err := counter.Write(metric); err != nil {
+			t.Fatalf("Failed to read back counter value for %q: %v", name, err)
+		}
+		if got := metric.GetCounter().GetValue(); got != incrementsPerMetric {
+			t.Fatalf("Expected %d events to be applied to %q across the worker pool, got %f", incrementsPerMetric, name, got)
+		}
+	}
+}
+
+// TestEventsDroppedWhenChannelFull validates that enqueue drops a batch
+// rather than blocking the listener when the ingestion channel is full.
+func TestEventsDroppedWhenChannelFull(t *testing.T) {
+	events := make(chan Events, 1)
+	events <- Events{&CounterEvent{metricName: "already_queued", value: 1}}
+
+	before := testutil.ToFloat64(eventsDroppedTotal)
+	enqueue(events, Events{&CounterEvent{metricName: "dropped", value: 1}})
+	after := testutil.ToFloat64(eventsDroppedTotal)
+
+	if after != before+1 {
+		t.Fatalf("Expected statsd_exporter_events_dropped_total to increase by 1, went from %f to %f", before, after)
+	}
+	if len(events) != 1 {
+		t.Fatalf("Expected the full channel to still hold only its original item, got %d", len(events))
+	}
+}
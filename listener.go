@@ -0,0 +1,210 @@
+// Copyright 2013 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// StatsDUDPListener reads statsd packets off a UDP socket.
+type StatsDUDPListener struct {
+	conn *net.UDPConn
+}
+
+// Listen reads datagrams off the UDP socket until it is closed, decoding
+// each one into Events.
+func (l *StatsDUDPListener) Listen(e chan<- Events) {
+	buf := make([]byte, 65535)
+	for {
+		n, _, err := l.conn.ReadFromUDP(buf)
+		if err != nil {
+			log.Debugf("UDP read failed: %v", err)
+			return
+		}
+		l.handlePacket(buf[0:n], e)
+	}
+}
+
+func (l *StatsDUDPListener) handlePacket(packet []byte, e chan<- Events) {
+	lines := strings.Split(string(packet), "\n")
+	events := Events{}
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		event, ok := parseLine(line)
+		if !ok {
+			continue
+		}
+		events = append(events, event)
+	}
+	if len(events) > 0 {
+		enqueue(e, events)
+	}
+}
+
+// StatsDTCPListener reads statsd packets off a TCP socket, one connection
+// per client.
+type StatsDTCPListener struct {
+	conn *net.TCPListener
+}
+
+// Listen accepts connections off the TCP socket until it is closed,
+// handling each one in its own goroutine.
+func (l *StatsDTCPListener) Listen(e chan<- Events) {
+	for {
+		c, err := l.conn.AcceptTCP()
+		if err != nil {
+			log.Debugf("TCP accept failed: %v", err)
+			return
+		}
+		go l.handleConn(c, e)
+	}
+}
+
+func (l *StatsDTCPListener) handleConn(c net.Conn, e chan<- Events) {
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		event, ok := parseLine(line)
+		if !ok {
+			continue
+		}
+		enqueue(e, Events{event})
+	}
+}
+
+// enqueue hands events to the Exporter's worker pool without blocking the
+// listener: if the channel is full, the batch is dropped and counted in
+// statsd_exporter_events_dropped_total rather than applying backpressure
+// all the way to the client socket.
+func enqueue(e chan<- Events, events Events) {
+	select {
+	case e <- events:
+		eventsQueued.Add(float64(len(events)))
+	default:
+		eventsDroppedTotal.Add(float64(len(events)))
+		log.Debugf("Dropping %d events: ingestion channel is full", len(events))
+	}
+}
+
+// parseLine decodes a single `name:value|type[|@sampleRate][|#tag:val,...]`
+// statsd line into an Event. Malformed lines are dropped rather than
+// causing a panic, so one bad sample from a client never takes down the
+// listener.
+func parseLine(line string) (Event, bool) {
+	parts := strings.Split(line, "|")
+	if len(parts) < 2 {
+		log.Debugf("Bad line from client: %s", line)
+		return nil, false
+	}
+
+	nameAndValue := strings.SplitN(parts[0], ":", 2)
+	if len(nameAndValue) != 2 {
+		log.Debugf("Bad line from client: %s", line)
+		return nil, false
+	}
+	metricName := nameAndValue[0]
+	valueStr := nameAndValue[1]
+	metricType := parts[1]
+
+	labels, ok := parseDatadogTags(parts[2:])
+	if !ok {
+		log.Debugf("Dropping line with invalid tags: %s", line)
+		return nil, false
+	}
+
+	switch metricType {
+	case "c":
+		value, err := strconv.ParseFloat(valueStr, 64)
+		if err != nil {
+			log.Debugf("Bad counter value in line: %s", line)
+			return nil, false
+		}
+		return &CounterEvent{metricName: metricName, value: value, labels: labels}, true
+
+	case "g":
+		relative := strings.HasPrefix(valueStr, "+") || strings.HasPrefix(valueStr, "-")
+		value, err := strconv.ParseFloat(valueStr, 64)
+		if err != nil {
+			log.Debugf("Bad gauge value in line: %s", line)
+			return nil, false
+		}
+		return &GaugeEvent{metricName: metricName, value: value, relative: relative, labels: labels}, true
+
+	case "ms":
+		value, err := strconv.ParseFloat(valueStr, 64)
+		if err != nil {
+			log.Debugf("Bad timer value in line: %s", line)
+			return nil, false
+		}
+		return &TimerEvent{metricName: metricName, value: value, labels: labels}, true
+
+	case "h":
+		value, err := strconv.ParseFloat(valueStr, 64)
+		if err != nil {
+			log.Debugf("Bad histogram value in line: %s", line)
+			return nil, false
+		}
+		return &HistogramEvent{metricName: metricName, value: value, labels: labels}, true
+
+	case "d":
+		value, err := strconv.ParseFloat(valueStr, 64)
+		if err != nil {
+			log.Debugf("Bad distribution value in line: %s", line)
+			return nil, false
+		}
+		return &DistributionEvent{metricName: metricName, value: value, labels: labels}, true
+
+	default:
+		log.Debugf("Unsupported metric type %q in line: %s", metricType, line)
+		return nil, false
+	}
+}
+
+// parseDatadogTags decodes the optional trailing `#tag:value,tag2:value2`
+// segment used by DogStatsD clients. Tag values containing invalid UTF-8
+// cause the whole sample to be dropped rather than propagated as a broken
+// label value.
+func parseDatadogTags(segments []string) (map[string]string, bool) {
+	var labels map[string]string
+	for _, segment := range segments {
+		if !strings.HasPrefix(segment, "#") {
+			continue
+		}
+		labels = make(map[string]string)
+		for _, tag := range strings.Split(segment[1:], ",") {
+			kv := strings.SplitN(tag, ":", 2)
+			key := kv[0]
+			value := ""
+			if len(kv) == 2 {
+				value = kv[1]
+			}
+			if !utf8.ValidString(key) || !utf8.ValidString(value) {
+				return nil, false
+			}
+			labels[key] = value
+		}
+	}
+	return labels, true
+}
@@ -0,0 +1,39 @@
+// Copyright 2013 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import stdlog "log"
+
+// logger is a thin wrapper around the standard library logger, giving the
+// rest of the package the small leveled-logging surface it uses without
+// pulling in an external logging dependency.
+type logger struct{}
+
+func (logger) Debugf(format string, args ...interface{}) {
+	stdlog.Printf("level=debug "+format, args...)
+}
+func (logger) Errorf(format string, args ...interface{}) {
+	stdlog.Printf("level=error "+format, args...)
+}
+func (logger) Infoln(args ...interface{}) {
+	stdlog.Println(append([]interface{}{"level=info"}, args...)...)
+}
+func (logger) Fatalf(format string, args ...interface{}) {
+	stdlog.Fatalf("level=fatal "+format, args...)
+}
+func (logger) Fatal(args ...interface{}) {
+	stdlog.Fatal(append([]interface{}{"level=fatal"}, args...)...)
+}
+
+var log logger
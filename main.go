@@ -0,0 +1,101 @@
+// Copyright 2013 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/version"
+)
+
+var (
+	listenAddress   = kingpin.Flag("web.listen-address", "The address on which to expose the web interface and generated Prometheus metrics.").Default(":9102").String()
+	metricsEndpoint = kingpin.Flag("web.telemetry-path", "Path under which to expose metrics.").Default("/metrics").String()
+	statsdListenUDP = kingpin.Flag("statsd.listen-udp", "The UDP address on which to receive statsd metric lines. \"\" disables it.").Default(":9125").String()
+	statsdListenTCP = kingpin.Flag("statsd.listen-tcp", "The TCP address on which to receive statsd metric lines. \"\" disables it.").Default(":9125").String()
+	mappingConfig   = kingpin.Flag("statsd.mapping-config", "Metric mapping configuration file name.").String()
+	cleanupEnabled  = kingpin.Flag("statsd.cleanup-enabled", "Periodically remove idle series that have exceeded their TTL.").Default("true").Bool()
+	cleanupInterval = kingpin.Flag("statsd.cleanup-interval", "How often to scan for and remove expired series.").Default("30s").Duration()
+	defaultTTL      = kingpin.Flag("statsd.default-ttl", "Default TTL for a series with no mapping override; 0 disables expiration.").Default("0s").Duration()
+	eventWorkers    = kingpin.Flag("statsd.event-workers", "Number of goroutines concurrently processing events off the ingestion channel.").Default("4").Int()
+)
+
+func serveHTTP(listenAddress, metricsEndpoint string) {
+	http.Handle(metricsEndpoint, promhttp.Handler())
+	log.Fatal(http.ListenAndServe(listenAddress, nil))
+}
+
+func watchConfig(fileName string, mapper *metricMapper) {
+	contents, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		log.Fatalf("Error reading mapping config %s: %v", fileName, err)
+	}
+	if err := mapper.initFromYAML(contents); err != nil {
+		log.Fatalf("Error parsing mapping config %s: %v", fileName, err)
+	}
+}
+
+func main() {
+	kingpin.Version(version.Print("statsd_exporter"))
+	kingpin.HelpFlag.Short('h')
+	kingpin.Parse()
+
+	log.Infoln("Starting statsd_exporter")
+
+	mapper := &metricMapper{}
+	if *mappingConfig != "" {
+		watchConfig(*mappingConfig, mapper)
+	}
+
+	exporter := NewExporter(mapper, *cleanupEnabled, *cleanupInterval, *defaultTTL)
+	exporter.Workers = *eventWorkers
+	prometheus.MustRegister(exporter)
+
+	events := make(chan Events, 1000)
+
+	if *statsdListenUDP != "" {
+		udpAddr, err := net.ResolveUDPAddr("udp", *statsdListenUDP)
+		if err != nil {
+			log.Fatalf("Error resolving statsd UDP address %s: %v", *statsdListenUDP, err)
+		}
+		conn, err := net.ListenUDP("udp", udpAddr)
+		if err != nil {
+			log.Fatalf("Error listening on statsd UDP address %s: %v", *statsdListenUDP, err)
+		}
+		l := &StatsDUDPListener{conn: conn}
+		go l.Listen(events)
+	}
+
+	if *statsdListenTCP != "" {
+		tcpAddr, err := net.ResolveTCPAddr("tcp", *statsdListenTCP)
+		if err != nil {
+			log.Fatalf("Error resolving statsd TCP address %s: %v", *statsdListenTCP, err)
+		}
+		tcpListener, err := net.ListenTCP("tcp", tcpAddr)
+		if err != nil {
+			log.Fatalf("Error listening on statsd TCP address %s: %v", *statsdListenTCP, err)
+		}
+		l := &StatsDTCPListener{conn: tcpListener}
+		go l.Listen(events)
+	}
+
+	go serveHTTP(*listenAddress, *metricsEndpoint)
+
+	exporter.Listen(events)
+}
@@ -0,0 +1,203 @@
+// Copyright 2013 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// timerType controls how a matched timer/histogram-ish event is represented
+// in Prometheus.
+type timerType int
+
+const (
+	timerTypeDefault timerType = iota
+	timerTypeHistogram
+	timerTypeSummary
+)
+
+func (t *timerType) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	switch s {
+	case "":
+		*t = timerTypeDefault
+	case "histogram":
+		*t = timerTypeHistogram
+	case "summary":
+		*t = timerTypeSummary
+	default:
+		return fmt.Errorf("invalid timer_type %q", s)
+	}
+	return nil
+}
+
+// expirationMode controls what resets the idle clock for a mapped series.
+type expirationMode string
+
+const (
+	// expireOnLastObservation is the default: the idle clock resets every
+	// time a new statsd event updates the series.
+	expireOnLastObservation expirationMode = "last_observation"
+	// expireOnLastScrape keeps a series alive as long as Prometheus keeps
+	// scraping it, even if no new statsd events arrive.
+	expireOnLastScrape expirationMode = "last_scrape"
+)
+
+func (e *expirationMode) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	switch expirationMode(s) {
+	case "", expireOnLastObservation:
+		*e = expireOnLastObservation
+	case expireOnLastScrape:
+		*e = expireOnLastScrape
+	default:
+		return fmt.Errorf("invalid expire_on mode %q", s)
+	}
+	return nil
+}
+
+// mappingDefaults holds the top level `defaults:` block of the mapping
+// config, applied to any metric that doesn't override a given field.
+type mappingDefaults struct {
+	TimerType timerType         `yaml:"timer_type"`
+	Buckets   []float64         `yaml:"buckets"`
+	Quantiles []metricObjective `yaml:"quantiles"`
+	Ttl       time.Duration     `yaml:"ttl"`
+	ExpireOn  expirationMode    `yaml:"expire_on"`
+}
+
+type metricObjective struct {
+	Quantile float64 `yaml:"quantile"`
+	Error    float64 `yaml:"error"`
+}
+
+// metricMapping is a single `mappings:` entry.
+type metricMapping struct {
+	Match     string            `yaml:"match"`
+	Name      string            `yaml:"name"`
+	Labels    map[string]string `yaml:"labels"`
+	TimerType timerType         `yaml:"timer_type"`
+	Buckets   []float64         `yaml:"buckets"`
+	Quantiles []metricObjective `yaml:"quantiles"`
+	Ttl       time.Duration     `yaml:"ttl"`
+	ExpireOn  expirationMode    `yaml:"expire_on"`
+
+	regex *regexp.Regexp
+}
+
+// metricMapper turns raw statsd metric names into Prometheus metric names
+// and label sets, per the loaded mapping config.
+type metricMapper struct {
+	Defaults mappingDefaults `yaml:"defaults"`
+	Mappings []metricMapping `yaml:"mappings"`
+
+	mu sync.RWMutex
+}
+
+// initFromYAML (re)compiles every mapping's regex. Exported so it can be
+// reused by config reload code in main.go.
+func (m *metricMapper) initFromYAML(fileContents []byte) error {
+	var mapper metricMapper
+	if err := yaml.Unmarshal(fileContents, &mapper); err != nil {
+		return err
+	}
+	for i := range mapper.Mappings {
+		regex, err := regexp.Compile(mapper.Mappings[i].Match)
+		if err != nil {
+			return fmt.Errorf("invalid match %q: %v", mapper.Mappings[i].Match, err)
+		}
+		mapper.Mappings[i].regex = regex
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Defaults = mapper.Defaults
+	m.Mappings = mapper.Mappings
+	return nil
+}
+
+// getMapping finds the first mapping whose regex matches statsdMetric, and
+// returns the translated Prometheus name plus any captured labels.
+func (m *metricMapper) getMapping(statsdMetric string) (*metricMapping, string, map[string]string) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for i := range m.Mappings {
+		mapping := &m.Mappings[i]
+		matches := mapping.regex.FindStringSubmatch(statsdMetric)
+		if matches == nil {
+			continue
+		}
+
+		name := mapping.Name
+		labels := make(map[string]string, len(mapping.Labels))
+		for label, valueExpr := range mapping.Labels {
+			value := valueExpr
+			for j, sub := range matches {
+				placeholder := fmt.Sprintf("$%d", j)
+				value = strings.Replace(value, placeholder, sub, -1)
+			}
+			labels[label] = value
+		}
+		for j, sub := range matches {
+			placeholder := fmt.Sprintf("$%d", j)
+			name = strings.Replace(name, placeholder, sub, -1)
+		}
+		return mapping, name, labels
+	}
+
+	return nil, "", nil
+}
+
+// ttlFor resolves the effective TTL for a (possibly nil) matched mapping,
+// falling back to the mapper-wide default.
+func (m *metricMapper) ttlFor(mapping *metricMapping) time.Duration {
+	if mapping != nil && mapping.Ttl > 0 {
+		return mapping.Ttl
+	}
+	return m.Defaults.Ttl
+}
+
+// expireOnFor resolves the effective expiration mode for a (possibly nil)
+// matched mapping, falling back to the mapper-wide default.
+func (m *metricMapper) expireOnFor(mapping *metricMapping) expirationMode {
+	if mapping != nil && mapping.ExpireOn != "" {
+		return mapping.ExpireOn
+	}
+	if m.Defaults.ExpireOn != "" {
+		return m.Defaults.ExpireOn
+	}
+	return expireOnLastObservation
+}
+
+// timerTypeFor resolves the effective timer type for a (possibly nil)
+// matched mapping, falling back to the mapper-wide default.
+func (m *metricMapper) timerTypeFor(mapping *metricMapping) timerType {
+	if mapping != nil && mapping.TimerType != timerTypeDefault {
+		return mapping.TimerType
+	}
+	return m.Defaults.TimerType
+}